@@ -0,0 +1,57 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"flag"
+	"fmt"
+)
+
+const (
+	backendLevelDB = "leveldb"
+	backendBadger  = "badger"
+)
+
+var chunkBackend = backendLevelDB
+var chunkCodecName = codecNames[CodecSnappy]
+
+// RegisterChunkBackendFlags registers --chunk-backend and --chunk-codec
+// alongside the existing RegisterLevelDBFlags/RegisterBadgerFlags, so
+// operators can pick a ChunkStore backend and compression codec at runtime
+// without recompiling.
+func RegisterChunkBackendFlags() {
+	flag.StringVar(&chunkBackend, "chunk-backend", backendLevelDB, fmt.Sprintf("on-disk ChunkStore backend to use: %q or %q", backendLevelDB, backendBadger))
+	flag.StringVar(&chunkCodecName, "chunk-codec", chunkCodecName, fmt.Sprintf("codec new chunk values are compressed with: %q, %q, or %q (existing data stored with any of these remains readable regardless of this flag)", codecNames[CodecSnappy], codecNames[CodecZstd], codecNames[CodecLZ4]))
+	RegisterLevelDBFlags()
+	RegisterBadgerFlags()
+}
+
+// ApplyChunkCodecFlag sets the active chunk codec from the value parsed
+// into --chunk-codec. It must be called after flag.Parse(), since flag
+// values aren't available at RegisterChunkBackendFlags time.
+func ApplyChunkCodecFlag() error {
+	for id, name := range codecNames {
+		if name == chunkCodecName {
+			activeCodec = codecsByID[id]
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown --chunk-codec %q", chunkCodecName)
+}
+
+// NewStoreFactoryUseFlags builds a Factory for whichever backend
+// --chunk-backend selected, using that backend's own flags (e.g.
+// --ldb-max-file-handles or --badger-value-log-gc-ratio) for its tuning
+// parameters.
+func NewStoreFactoryUseFlags(dir string) Factory {
+	switch chunkBackend {
+	case backendBadger:
+		return NewBadgerStoreFactoryUseFlags(dir)
+	case backendLevelDB:
+		return NewLevelDBStoreFactoryUseFlags(dir)
+	default:
+		panic(fmt.Sprintf("unknown --chunk-backend %q, must be %q or %q", chunkBackend, backendLevelDB, backendBadger))
+	}
+}
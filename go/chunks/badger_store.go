@@ -0,0 +1,298 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+
+	"github.com/attic-labs/noms/go/d"
+)
+
+type BadgerStoreFlags struct {
+	valueLogGCRatio float64
+	dumpStats       bool
+}
+
+var (
+	badgerFlags           = BadgerStoreFlags{0.5, false}
+	badgerFlagsRegistered = false
+)
+
+// RegisterBadgerFlags registers the flags specific to the Badger backend.
+// Callers that only ever use the leveldb backend don't need to call this;
+// it's pulled in automatically by RegisterChunkBackendFlags.
+func RegisterBadgerFlags() {
+	if !badgerFlagsRegistered {
+		badgerFlagsRegistered = true
+		flag.Float64Var(&badgerFlags.valueLogGCRatio, "badger-value-log-gc-ratio", 0.5, "run Badger's value-log GC when it could reclaim at least this fraction of a log file")
+		flag.BoolVar(&badgerFlags.dumpStats, "badger-dump-stats", false, "print get/has/put counts on close")
+	}
+}
+
+func NewBadgerStoreUseFlags(dir, ns string) *BadgerStore {
+	return newBadgerStore(newBadgerBackend(dir, badgerFlags.valueLogGCRatio, badgerFlags.dumpStats), []byte(ns), true)
+}
+
+func NewBadgerStore(dir, ns string, dumpStats bool) *BadgerStore {
+	return newBadgerStore(newBadgerBackend(dir, badgerFlags.valueLogGCRatio, dumpStats), []byte(ns), true)
+}
+
+func newBadgerStore(backend *badgerBackend, ns []byte, closeBackingStore bool) *BadgerStore {
+	return &BadgerStore{newKVStore(backend, ns, closeBackingStore)}
+}
+
+// BadgerStore is a ChunkStore backed by BadgerDB. Like LevelDBStore, it is
+// just a kvStore wired up to its own KVBackend; the namespacing, chunk
+// encoding, and root CAS semantics are shared, not duplicated.
+type BadgerStore struct {
+	kvStore
+}
+
+func NewBadgerStoreFactory(dir string, opts ...BadgerOption) Factory {
+	backend := newBadgerBackend(dir, badgerFlags.valueLogGCRatio, badgerFlags.dumpStats)
+	for _, opt := range opts {
+		opt(backend)
+	}
+	return &BadgerStoreFactory{dir, backend}
+}
+
+func NewBadgerStoreFactoryUseFlags(dir string) Factory {
+	return NewBadgerStoreFactory(dir)
+}
+
+// BadgerOption configures a BadgerStoreFactory's underlying database at
+// construction time, e.g. NewBadgerStoreFactory(dir, WithValueLogGCRatio(0.7)).
+type BadgerOption func(*badgerBackend)
+
+// WithValueLogGCRatio overrides the fraction of a value-log file Badger's
+// GC must be able to reclaim before it will rewrite that file.
+func WithValueLogGCRatio(ratio float64) BadgerOption {
+	return func(b *badgerBackend) { b.valueLogGCRatio = ratio }
+}
+
+type BadgerStoreFactory struct {
+	dir     string
+	backend *badgerBackend
+}
+
+func (f *BadgerStoreFactory) CreateStore(ns string) ChunkStore {
+	d.Chk.True(f.backend != nil, "Cannot use BadgerStoreFactory after Shutter().")
+	return newBadgerStore(f.backend, []byte(ns), false)
+}
+
+func (f *BadgerStoreFactory) Shutter() {
+	f.backend.Close()
+	f.backend = nil
+}
+
+// badgerBackend is a KVBackend backed by a single BadgerDB handle, shared
+// across every namespaced BadgerStore opened on top of it. Reads and writes
+// go through Badger's MVCC transactions rather than a process-local mutex,
+// so CompareAndSwap is a true conflict-checked CAS rather than a
+// coarse-grained critical section.
+type badgerBackend struct {
+	db                                     *badger.DB
+	valueLogGCRatio                        float64
+	getCount, hasCount, putCount, putBytes int64
+	dumpStats                              bool
+}
+
+func newBadgerBackend(dir string, valueLogGCRatio float64, dumpStats bool) *badgerBackend {
+	d.Exp.NotEmpty(dir)
+	// Compression is handled uniformly by ChunkCodec before a value ever
+	// reaches a KVBackend (see codec.go), so Badger's own internal
+	// compression would just burn CPU recompressing already-compressed
+	// bytes -- and silently defeat a cheap --chunk-codec=snappy choice.
+	opts := badger.DefaultOptions(dir).
+		WithCompression(options.None).
+		WithLogger(nil)
+	db, err := badger.Open(opts)
+	d.Chk.NoError(err, "opening badgerBackend in %s", dir)
+	return &badgerBackend{
+		db:              db,
+		valueLogGCRatio: valueLogGCRatio,
+		dumpStats:       dumpStats,
+	}
+}
+
+func (b *badgerBackend) Get(key []byte) ([]byte, bool) {
+	var val []byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	b.getCount++
+	if err == badger.ErrKeyNotFound {
+		return nil, false
+	}
+	d.Chk.NoError(err)
+	return val, true
+}
+
+func (b *badgerBackend) Has(key []byte) bool {
+	var found bool
+	err := b.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		err = nil
+	}
+	d.Chk.NoError(err)
+	b.hasCount++
+	return found
+}
+
+func (b *badgerBackend) Put(key, val []byte) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+	if err == nil {
+		b.putCount++
+		b.putBytes += int64(len(val))
+	}
+	return err
+}
+
+func (b *badgerBackend) PutBatch(kvs []KV) error {
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+	numBytes := 0
+	for _, kv := range kvs {
+		if err := wb.Set(kv.Key, kv.Value); err != nil {
+			return err
+		}
+		numBytes += len(kv.Value)
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	b.putCount += int64(len(kvs))
+	b.putBytes += int64(numBytes)
+	return nil
+}
+
+// CompareAndSwap runs the swap plus every write in extra inside a single
+// Badger transaction. Badger's MVCC conflict detection means this is a true
+// CAS even with no lock of our own: if another transaction commits a
+// conflicting write to key first, this one fails to commit with
+// ErrConflict, which the caller sees as a swap that didn't happen.
+//
+// db.Update alone doesn't guarantee newVal survives a crash: like goleveldb,
+// Badger is opened with async writes (see newBadgerBackend) so that the much
+// more frequent Put/PutBatch chunk writes aren't all paying fsync latency.
+// A successful swap forces a db.Sync() before returning, the same way
+// leveldbBackend.CompareAndSwap passes opt.WriteOptions{Sync: true} only on
+// the root key's write -- a committed root specifically must survive a
+// crash, since a ChunkStore caller treats a successful CompareAndSwap as
+// durable.
+func (b *badgerBackend) CompareAndSwap(key, expected, newVal []byte, extra []KV) (bool, error) {
+	swapped := false
+	err := b.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		var cur []byte
+		if err == nil {
+			if cur, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		if (err == badger.ErrKeyNotFound) == (len(expected) > 0) {
+			return nil // mismatch between "key exists" and "expected is set"
+		}
+		if err == nil && !bytes.Equal(cur, expected) {
+			return nil
+		}
+
+		if err := txn.Set(key, newVal); err != nil {
+			return err
+		}
+		for _, kv := range extra {
+			if err := txn.Set(kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+		swapped = true
+		return nil
+	})
+	if err == badger.ErrConflict {
+		// Another transaction raced us for this key; the caller retries.
+		return false, nil
+	}
+	if swapped && err == nil {
+		err = b.db.Sync()
+	}
+	return swapped, err
+}
+
+func (b *badgerBackend) Delete(key []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (b *badgerBackend) Iterate(prefix []byte, fn func(key, val []byte) bool) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(item.KeyCopy(nil), val) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerBackend) Close() error {
+	// Run the value-log GC one last time before closing; RunValueLogGC
+	// returns ErrNoRewrite once there's nothing left worth reclaiming, which
+	// is the expected, non-error steady state.
+	for {
+		if err := b.db.RunValueLogGC(b.valueLogGCRatio); err != nil {
+			break
+		}
+	}
+	err := b.db.Close()
+	if b.dumpStats {
+		fmt.Println("--Badger Stats--")
+		fmt.Println("GetCount: ", b.getCount)
+		fmt.Println("HasCount: ", b.hasCount)
+		fmt.Println("PutCount: ", b.putCount)
+		fmt.Print(dumpCodecStats())
+	}
+	return err
+}
+
+func (b *badgerBackend) Stats() BackendStats {
+	return BackendStats{
+		GetCount: b.getCount,
+		HasCount: b.hasCount,
+		PutCount: b.putCount,
+		PutBytes: b.putBytes,
+	}
+}
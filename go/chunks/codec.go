@@ -0,0 +1,218 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Chunk values are compressed before they ever reach a KVBackend. Which
+// codec compressed a given value is recorded as a 1-byte tag prepended to
+// the stored bytes, so a database can mix codecs over its lifetime -- e.g.
+// after an operator flips --chunk-codec -- without a migration. Whether a
+// store's values carry the tag at all is decided once per store (see the
+// note above encodeChunkTagged): a store created before the tag existed
+// keeps reading and writing plain, untagged snappy, so existing databases
+// keep reading correctly. Within a tagged store, a value whose first byte
+// isn't a registered codec ID is a decode error, not a snappy fallback.
+type ChunkCodec interface {
+	// ID is the 1-byte tag prepended to values this codec compresses.
+	ID() byte
+
+	// Encode compresses data. The codec tag is not included; callers
+	// prepend it themselves so it can be inspected without invoking a codec.
+	Encode(data []byte) []byte
+
+	// Decode reverses Encode. data does not include the codec tag.
+	Decode(data []byte) ([]byte, error)
+}
+
+const (
+	// CodecSnappy is also the implicit codec for values stored before the
+	// codec tag existed, so its ID must never change.
+	CodecSnappy byte = 1
+	CodecZstd   byte = 2
+	CodecLZ4    byte = 3
+)
+
+var codecsByID = map[byte]ChunkCodec{
+	CodecSnappy: snappyCodec{},
+	CodecZstd:   zstdCodec{},
+	CodecLZ4:    lz4Codec{},
+}
+
+// activeCodec is the codec new writes are encoded with; selected via
+// --chunk-codec (see RegisterChunkBackendFlags). Existing data encoded with
+// a different registered codec remains readable regardless of this setting.
+var activeCodec ChunkCodec = codecsByID[CodecSnappy]
+
+// A tagged store's first byte and an untagged store's first byte are both
+// just "whatever byte happens to come first" -- an old, pre-codec-tag
+// snappy blob's first byte is snappy's own uvarint length prefix, which can
+// legitimately equal 1, 2, or 3 (any registered codec ID) for a short
+// enough chunk. So "does the first byte look like a codec tag" is not a
+// safe per-value test. Instead, whether a store's values carry a tag at
+// all is decided once, durably, per store (see kvStore.taggedChunkFormat)
+// the first time it's opened, and never revisited: a store created before
+// this tagging scheme existed stays on plain, untagged snappy forever, and
+// a store created after it always tags. The two formats never have to be
+// told apart value-by-value within the same store.
+
+// encodeChunkTagged compresses data with the active codec and returns it
+// with its 1-byte codec tag prepended. Only used by stores whose
+// taggedChunkFormat is true.
+func encodeChunkTagged(data []byte) []byte {
+	encoded := activeCodec.Encode(data)
+	codecStatsFor(activeCodec.ID()).recordPut(len(encoded) + 1)
+	return append([]byte{activeCodec.ID()}, encoded...)
+}
+
+// decodeChunkTagged strips and interprets a tagged store's codec tag and
+// returns the decompressed chunk data. An unrecognized tag is a hard error
+// rather than a silent fallback, since a tagged store's values are never
+// ambiguous: they were written by a registered codec or not written by this
+// code at all.
+func decodeChunkTagged(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("decodeChunkTagged: empty stored value has no codec tag")
+	}
+	codec, ok := codecsByID[stored[0]]
+	if !ok {
+		return nil, fmt.Errorf("decodeChunkTagged: unrecognized codec tag %d", stored[0])
+	}
+	codecStatsFor(codec.ID()).recordGet(len(stored))
+	return codec.Decode(stored[1:])
+}
+
+// encodeChunkLegacy/decodeChunkLegacy are the pre-chunk0-4 on-disk format:
+// plain snappy, no tag byte. Used for stores whose taggedChunkFormat is
+// false, so their existing data is never misread as tagged.
+func encodeChunkLegacy(data []byte) []byte {
+	encoded := snappyCodec{}.Encode(data)
+	codecStatsFor(CodecSnappy).recordPut(len(encoded))
+	return encoded
+}
+
+func decodeChunkLegacy(stored []byte) ([]byte, error) {
+	codecStatsFor(CodecSnappy).recordGet(len(stored))
+	return snappyCodec{}.Decode(stored)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte                           { return CodecSnappy }
+func (snappyCodec) Encode(data []byte) []byte          { return snappy.Encode(nil, data) }
+func (snappyCodec) Decode(data []byte) ([]byte, error) { return snappy.Decode(nil, data) }
+
+type zstdCodec struct{}
+
+func (zstdCodec) ID() byte { return CodecZstd }
+
+func (zstdCodec) Encode(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+func (zstdCodec) Decode(data []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, nil)
+}
+
+// zstdEncoder/zstdDecoder are shared across every zstdCodec use; both types
+// are safe for concurrent use and expensive enough to set up that we don't
+// want one per call.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// lz4Codec uses lz4's block format rather than its streaming frame format,
+// since a chunk's whole (already-small) body is compressed in one shot.
+// UncompressBlock needs to know the decompressed size up front, so Encode
+// prepends a 4-byte big-endian original length ahead of the compressed block.
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte { return CodecLZ4 }
+
+func (lz4Codec) Encode(data []byte) []byte {
+	buf := make([]byte, 4+lz4.CompressBlockBound(len(data)))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+
+	var c lz4.Compressor
+	n, err := c.CompressBlock(data, buf[4:])
+	if err != nil || n == 0 || n >= len(data) {
+		// Incompressible (or too small to bother): fall back to storing the
+		// data verbatim, still behind the length prefix so Decode has one
+		// code path. A compressed block is therefore always shorter than
+		// the original, which is how Decode tells the two apart.
+		return append(buf[:4], data...)
+	}
+	return buf[:4+n]
+}
+
+func (lz4Codec) Decode(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("lz4Codec: stored value too short to contain a length prefix: %d bytes", len(data))
+	}
+	origLen := int(binary.BigEndian.Uint32(data))
+	compressed := data[4:]
+	if len(compressed) == origLen {
+		// The incompressible-data fallback from Encode.
+		return compressed, nil
+	}
+	dst := make([]byte, origLen)
+	n, err := lz4.UncompressBlock(compressed, dst)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// codecCounters tracks per-codec Get/Put counts and bytes for dumpStats, so
+// operators A/B-ing --chunk-codec can see compression ratios on real data.
+type codecCounters struct {
+	getCount, putCount, bytes int64
+}
+
+func (c *codecCounters) recordGet(storedBytes int) {
+	atomic.AddInt64(&c.getCount, 1)
+	atomic.AddInt64(&c.bytes, int64(storedBytes))
+}
+
+func (c *codecCounters) recordPut(storedBytes int) {
+	atomic.AddInt64(&c.putCount, 1)
+	atomic.AddInt64(&c.bytes, int64(storedBytes))
+}
+
+var codecStats = map[byte]*codecCounters{
+	CodecSnappy: {},
+	CodecZstd:   {},
+	CodecLZ4:    {},
+}
+
+func codecStatsFor(id byte) *codecCounters {
+	return codecStats[id]
+}
+
+var codecNames = map[byte]string{
+	CodecSnappy: "snappy",
+	CodecZstd:   "zstd",
+	CodecLZ4:    "lz4",
+}
+
+// dumpCodecStats formats the accumulated per-codec counters for inclusion
+// in a ChunkStore backend's dumpStats output.
+func dumpCodecStats() string {
+	out := "--Chunk Codec Stats--\n"
+	for _, id := range []byte{CodecSnappy, CodecZstd, CodecLZ4} {
+		c := codecStats[id]
+		out += fmt.Sprintf("%s: gets=%d puts=%d bytes=%d\n", codecNames[id], atomic.LoadInt64(&c.getCount), atomic.LoadInt64(&c.putCount), atomic.LoadInt64(&c.bytes))
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/attic-labs/noms/go/hash"
+)
+
+func TestChunkCodecRoundTrip(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog, repeated for compressibility: " +
+		"the quick brown fox jumps over the lazy dog")
+	for id, codec := range codecsByID {
+		encoded := codec.Encode(data)
+		decoded, err := codec.Decode(encoded)
+		if err != nil {
+			t.Fatalf("codec %d: Decode: %v", id, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("codec %d: round trip mismatch: got %q, want %q", id, decoded, data)
+		}
+	}
+}
+
+func TestEncodeDecodeChunkTagged(t *testing.T) {
+	data := []byte("tagged chunk payload")
+	stored := encodeChunkTagged(data)
+	if stored[0] != activeCodec.ID() {
+		t.Fatalf("encodeChunkTagged: first byte %d, want activeCodec.ID() %d", stored[0], activeCodec.ID())
+	}
+	decoded, err := decodeChunkTagged(stored)
+	if err != nil {
+		t.Fatalf("decodeChunkTagged: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("decodeChunkTagged round trip mismatch: got %q, want %q", decoded, data)
+	}
+}
+
+func TestDecodeChunkTaggedUnrecognizedTag(t *testing.T) {
+	if _, err := decodeChunkTagged([]byte{0xff, 'x'}); err == nil {
+		t.Fatal("decodeChunkTagged: expected an error for an unrecognized codec tag, got nil")
+	}
+}
+
+func TestEncodeDecodeChunkLegacy(t *testing.T) {
+	data := []byte("legacy chunk payload")
+	stored := encodeChunkLegacy(data)
+	decoded, err := decodeChunkLegacy(stored)
+	if err != nil {
+		t.Fatalf("decodeChunkLegacy: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("decodeChunkLegacy round trip mismatch: got %q, want %q", decoded, data)
+	}
+}
+
+// TestDetectChunkFormatTaggedVsLegacy covers the chunk0-4 decision
+// detectChunkFormat makes once per store: brand new stores (no root yet)
+// pin to the tagged format, while a store that already has a root but no
+// format marker predates tagging and must stay legacy forever.
+func TestDetectChunkFormatTaggedVsLegacy(t *testing.T) {
+	t.Run("new store is tagged", func(t *testing.T) {
+		s := newKVStore(newFakeBackend(), []byte("ns/"), true)
+		if !s.taggedChunkFormat {
+			t.Error("a brand new store should detect as tagged")
+		}
+	})
+
+	t.Run("pre-existing root with no marker is legacy", func(t *testing.T) {
+		backend := newFakeBackend()
+		// Simulate a store from before the format marker existed: a root is
+		// already present, but no /format key.
+		ns := []byte("ns/")
+		rootKey := append(append([]byte{}, ns...), []byte(rootKeyConst)...)
+		if err := backend.Put(rootKey, []byte(hash.Hash{1}.String())); err != nil {
+			t.Fatal(err)
+		}
+		s := newKVStore(backend, ns, true)
+		if s.taggedChunkFormat {
+			t.Error("a store with a pre-existing root and no marker should detect as legacy")
+		}
+	})
+
+	t.Run("decision persists across reopen", func(t *testing.T) {
+		backend := newFakeBackend()
+		ns := []byte("ns/")
+		first := newKVStore(backend, ns, false)
+		second := newKVStore(backend, ns, true)
+		if first.taggedChunkFormat != second.taggedChunkFormat {
+			t.Error("reopening the same backend/namespace should reuse the persisted format decision")
+		}
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// fakeBackend is an in-memory KVBackend used only by this package's tests.
+// It's deliberately minimal -- no persistence, no batching optimizations --
+// but it implements the full interface so kvStore and RootFeed can be
+// exercised without a real on-disk engine. casHook, when set, runs while
+// CompareAndSwap holds its lock but before the swap is applied, letting a
+// test pause a Commit mid-flight to observe what's visible while it's still
+// in progress.
+type fakeBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+
+	casHook func()
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{data: map[string][]byte{}}
+}
+
+func (f *fakeBackend) Get(key []byte) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val, ok := f.data[string(key)]
+	return val, ok
+}
+
+func (f *fakeBackend) Has(key []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.data[string(key)]
+	return ok
+}
+
+func (f *fakeBackend) Put(key, val []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[string(key)] = val
+	return nil
+}
+
+func (f *fakeBackend) PutBatch(kvs []KV) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, kv := range kvs {
+		f.data[string(kv.Key)] = kv.Value
+	}
+	return nil
+}
+
+func (f *fakeBackend) CompareAndSwap(key, expected, newVal []byte, extra []KV) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.casHook != nil {
+		f.casHook()
+	}
+	cur, ok := f.data[string(key)]
+	if (!ok) != (len(expected) == 0) {
+		return false, nil
+	}
+	if ok && !bytes.Equal(cur, expected) {
+		return false, nil
+	}
+	f.data[string(key)] = newVal
+	for _, kv := range extra {
+		f.data[string(kv.Key)] = kv.Value
+	}
+	return true, nil
+}
+
+func (f *fakeBackend) Iterate(prefix []byte, fn func(key, val []byte) bool) error {
+	f.mu.Lock()
+	var keys []string
+	for k := range f.data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	vals := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		vals[k] = f.data[k]
+	}
+	f.mu.Unlock()
+
+	for _, k := range keys {
+		if !fn([]byte(k), vals[k]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeBackend) Delete(key []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.data, string(key))
+	return nil
+}
+
+func (f *fakeBackend) Close() error { return nil }
+
+func (f *fakeBackend) Stats() BackendStats { return BackendStats{} }
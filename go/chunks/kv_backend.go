@@ -0,0 +1,85 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+// KVBackend is the minimal durable key/value contract that a ChunkStore
+// on-disk implementation is built on top of. It knows nothing about chunks,
+// namespaces, or root hashes -- those concerns live in kvStore -- it is
+// just bytes in, bytes out, plus the handful of operations (batched writes,
+// a single-key compare-and-swap, and prefix iteration) that the store layer
+// needs in order to implement Get/Has/Put/PutMany/UpdateRoot.
+//
+// LevelDBStore and BadgerStore are both thin adapters over a KVBackend, so
+// a new on-disk engine can be plugged in without touching the ChunkStore
+// semantics (namespacing, chunk encoding, root CAS) at all.
+type KVBackend interface {
+	// Get returns the value stored at key, and whether it was found.
+	Get(key []byte) (val []byte, ok bool)
+
+	// Has reports whether key is present, without paying for the value read.
+	Has(key []byte) bool
+
+	// Put writes a single key/value pair. Unlike CompareAndSwap, it is not
+	// synced to disk before returning.
+	Put(key, val []byte) error
+
+	// PutBatch writes every entry in kvs as a single atomic batch. Like Put,
+	// it is not synced to disk before returning.
+	PutBatch(kvs []KV) error
+
+	// CompareAndSwap atomically sets key to newVal, and writes every pair in
+	// extra, iff key's current value equals expected. A nil/empty expected
+	// means key must not currently exist. extra is written unconditionally
+	// as part of the same durable transaction as the swap, so a caller can
+	// publish a new root alongside the ref logs and index entries it
+	// depends on in one atomic step. It reports whether the swap took place;
+	// when it returns false, extra is not written either.
+	CompareAndSwap(key, expected, newVal []byte, extra []KV) (bool, error)
+
+	// Iterate calls fn with every stored key/value pair whose key has the
+	// given prefix, in key order, stopping early if fn returns false.
+	Iterate(prefix []byte, fn func(key, val []byte) bool) error
+
+	// Delete removes key. Deleting an absent key is not an error. It exists
+	// for callers that manage their own retention over an append-only keyspace
+	// (e.g. RootFeed's on-disk log compaction), not for general chunk data.
+	Delete(key []byte) error
+
+	// Close releases the backend's resources. It is safe to call exactly once.
+	Close() error
+
+	// Stats returns a point-in-time snapshot of backend counters.
+	Stats() BackendStats
+}
+
+// NewLevelDBBackend opens a raw, un-namespaced KVBackend backed by
+// goleveldb. Unlike LevelDBStore, it has no notion of chunks, content
+// hashing, or a root key -- it's useful for callers that just want a
+// durable, sorted-iteration key/value store, such as mvdata's
+// external-sort spill for bulk table loads.
+func NewLevelDBBackend(dir string, maxFileHandles int, dumpStats bool) KVBackend {
+	return newLevelDBBackend(dir, maxFileHandles, dumpStats)
+}
+
+// KV is a single key/value pair, used for batched writes via PutBatch and
+// for the extra writes bundled into a CompareAndSwap.
+type KV struct {
+	Key, Value []byte
+}
+
+// Op is a single key/value write submitted to ChunkStore.Commit. It has the
+// same shape as KV; Commit's callers think in terms of "operations that
+// make up a transaction" rather than the backend's raw batched writes, so
+// it gets its own name.
+type Op = KV
+
+// BackendStats holds the counters every KVBackend implementation tracks so
+// that dumpStats output is comparable across backends.
+type BackendStats struct {
+	GetCount int64
+	HasCount int64
+	PutCount int64
+	PutBytes int64
+}
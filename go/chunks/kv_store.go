@@ -0,0 +1,316 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/hash"
+)
+
+const (
+	rootKeyConst     = "/root"
+	chunkPrefixConst = "/chunk/"
+	formatKeyConst   = "/format"
+)
+
+// formatTagged/formatLegacy are the values stored at a store's formatKey,
+// recording once and for all whether its chunks carry a codec tag.
+const (
+	formatLegacy byte = 0
+	formatTagged byte = 1
+)
+
+// kvStore implements the ChunkStore namespacing, chunk encoding, and root
+// CAS semantics shared by every on-disk backend, driven entirely through the
+// backend-agnostic KVBackend interface. LevelDBStore and BadgerStore are
+// both a kvStore wired up to their own KVBackend.
+type kvStore struct {
+	backend           KVBackend
+	ns                []byte
+	rootKey           []byte
+	chunkPrefix       []byte
+	formatKey         []byte
+	closeBackingStore bool
+
+	// taggedChunkFormat is decided once, durably, the first time this store
+	// is opened (see detectChunkFormat): stores created before the codec
+	// tag existed stay on plain, untagged snappy forever; stores created
+	// after it always tag. This keeps the two formats from ever needing to
+	// be told apart value-by-value within the same store (see codec.go).
+	taggedChunkFormat bool
+
+	// feed is nil unless EnableRootFeed has been called; publishing a
+	// RootEvent on every committed root transition is opt-in, not automatic.
+	feed *RootFeed
+
+	// pendingMu guards pending, the chunks PutMany has accepted but that
+	// haven't been durably written yet. They ride along on the next Commit
+	// (including the one UpdateRoot issues) so that a "flush the working
+	// set, then advance the root" caller gets the atomic publish the two-
+	// phase PutMany-then-UpdateRoot couldn't give it. pending is keyed by
+	// chunk key so Get/Has can serve a chunk PutMany just accepted without
+	// waiting for it to land in the backend -- a caller building a tree out
+	// of chunks it just wrote, before it has a root to swap in, still needs
+	// read-your-writes.
+	pendingMu sync.Mutex
+	pending   map[string]Op
+}
+
+func newKVStore(backend KVBackend, ns []byte, closeBackingStore bool) kvStore {
+	copyNsAndAppend := func(suffix string) (out []byte) {
+		out = make([]byte, len(ns)+len(suffix))
+		copy(out[copy(out, ns):], []byte(suffix))
+		return
+	}
+	s := kvStore{
+		backend:           backend,
+		ns:                ns,
+		rootKey:           copyNsAndAppend(rootKeyConst),
+		chunkPrefix:       copyNsAndAppend(chunkPrefixConst),
+		formatKey:         copyNsAndAppend(formatKeyConst),
+		closeBackingStore: closeBackingStore,
+	}
+	s.taggedChunkFormat = s.detectChunkFormat()
+	return s
+}
+
+// detectChunkFormat reads this store's durable format marker, writing one
+// if this is the first time the store has ever been opened: a store with no
+// root yet is brand new, so it starts tagged; a store that already has a
+// root but no marker predates the marker itself, so it's pinned to the
+// legacy untagged format it was already using. Either way, the decision is
+// made exactly once per store and never revisited -- which is also why the
+// marker write can't be allowed to fail silently: an unpersisted decision
+// here means a restart re-derives it, and a store that picks differently
+// the second time around will misdecode every chunk written under the
+// first decision.
+func (s *kvStore) detectChunkFormat() bool {
+	if val, ok := s.backend.Get(s.formatKey); ok && len(val) > 0 {
+		return val[0] == formatTagged
+	}
+	tagged := !s.backend.Has(s.rootKey)
+	marker := formatLegacy
+	if tagged {
+		marker = formatTagged
+	}
+	d.Chk.NoError(s.backend.Put(s.formatKey, []byte{marker}), "persisting chunk format marker")
+	return tagged
+}
+
+func (s *kvStore) encodeChunkData(data []byte) []byte {
+	if s.taggedChunkFormat {
+		return encodeChunkTagged(data)
+	}
+	return encodeChunkLegacy(data)
+}
+
+func (s *kvStore) decodeChunkData(stored []byte) ([]byte, error) {
+	if s.taggedChunkFormat {
+		return decodeChunkTagged(stored)
+	}
+	return decodeChunkLegacy(stored)
+}
+
+// EnableRootFeed turns on this store's RootFeed: from this call on, every
+// root transition UpdateRoot or Commit successfully applies is published to
+// it. retention is how many events the feed's on-disk log keeps behind its
+// slowest subscriber's watermark (see RootFeed.compact); pass
+// defaultFeedRetention for --root-feed-retention's default.
+func (s *kvStore) EnableRootFeed(retention uint64) *RootFeed {
+	s.feed = newRootFeed(s.backend, s.ns, retention)
+	return s.feed
+}
+
+// EnableRootFeedUseFlags is EnableRootFeed using --root-feed-retention's
+// value (see RegisterRootFeedFlags).
+func (s *kvStore) EnableRootFeedUseFlags() *RootFeed {
+	return s.EnableRootFeed(rootFeedRetention)
+}
+
+// Subscribe is a convenience passthrough to the store's RootFeed. It panics
+// if EnableRootFeed hasn't been called, the same way using a store after
+// Close does.
+func (s *kvStore) Subscribe(fromSeq uint64) (<-chan RootEvent, CancelFunc) {
+	d.Chk.True(s.feed != nil, "Cannot Subscribe before EnableRootFeed().")
+	return s.feed.Subscribe(fromSeq)
+}
+
+func (s *kvStore) Root() hash.Hash {
+	d.Chk.True(s.backend != nil, "Cannot use store after Close().")
+	val, ok := s.backend.Get(s.rootKey)
+	if !ok {
+		return hash.Hash{}
+	}
+	return hash.Parse(string(val))
+}
+
+func (s *kvStore) UpdateRoot(current, last hash.Hash) bool {
+	ok, err := s.Commit(nil, last, current)
+	d.Chk.NoError(err)
+	return ok
+}
+
+// Commit atomically advances the store's root from expectedRoot to newRoot,
+// durably writing every op in ops, plus every chunk PutMany has accepted
+// since the last Commit, as part of the same transaction as the root swap.
+// Callers that need to publish a batch of chunks, ref logs, or index
+// entries alongside a new root -- e.g. an importer's "flush the working
+// set, then advance the root" step -- can pass those as ops, or simply call
+// PutMany followed by UpdateRoot: either way they land in the same
+// transaction as the root swap, not two separate ones. It reports whether
+// expectedRoot still matched the stored root at commit time; on a false
+// return, nothing was written, and any chunks PutMany had queued are kept
+// pending for the next Commit to retry.
+func (s *kvStore) Commit(ops []Op, expectedRoot, newRoot hash.Hash) (bool, error) {
+	d.Chk.True(s.backend != nil, "Cannot use store after Close().")
+
+	// Snapshot pending rather than clearing it: s.pending must keep serving
+	// Get/Has for these chunks for as long as the CAS below is in flight,
+	// since until it resolves they're neither committed to s.backend yet nor
+	// (if we'd cleared s.pending up front) anywhere else a reader could find
+	// them.
+	s.pendingMu.Lock()
+	pending := make(map[string]Op, len(s.pending))
+	for k, op := range s.pending {
+		pending[k] = op
+	}
+	s.pendingMu.Unlock()
+
+	allOps := make([]Op, 0, len(pending)+len(ops))
+	for _, op := range pending {
+		allOps = append(allOps, op)
+	}
+	allOps = append(allOps, ops...)
+
+	// A zero hash.Hash means "no root written yet", which CompareAndSwap
+	// represents as a nil expected value rather than the zero hash's string
+	// encoding, so that it actually matches an absent rootKey.
+	var expected []byte
+	if expectedRoot != (hash.Hash{}) {
+		expected = []byte(expectedRoot.String())
+	}
+	ok, err := s.backend.CompareAndSwap(s.rootKey, expected, []byte(newRoot.String()), allOps)
+	if !ok || err != nil {
+		// The swap didn't happen (or failed outright): leave the PutMany-
+		// sourced chunks in s.pending so a caller that retries doesn't lose
+		// writes PutMany already accepted. ops, in contrast, is this call's
+		// own argument -- its caller still has it and owns retrying it.
+		return ok, err
+	}
+
+	// The CAS committed, so every entry in the pending snapshot is now
+	// durable in s.backend: drop exactly those from s.pending, not the map
+	// wholesale, since a concurrent PutMany could have added more to it
+	// while this CAS was in flight -- and could in principle have
+	// overwritten one of these same keys with a newer value that hasn't been
+	// committed yet, which must stay pending.
+	s.pendingMu.Lock()
+	for k, op := range pending {
+		if cur, stillPending := s.pending[k]; stillPending && bytes.Equal(cur.Value, op.Value) {
+			delete(s.pending, k)
+		}
+	}
+	s.pendingMu.Unlock()
+
+	if s.feed != nil {
+		s.feed.publish(expectedRoot, newRoot)
+	}
+	return ok, err
+}
+
+func (s *kvStore) Get(ref hash.Hash) Chunk {
+	d.Chk.True(s.backend != nil, "Cannot use store after Close().")
+	key := s.toChunkKey(ref)
+
+	s.pendingMu.Lock()
+	op, isPending := s.pending[string(key)]
+	s.pendingMu.Unlock()
+	if isPending {
+		data, err := s.decodeChunkData(op.Value)
+		d.Chk.NoError(err)
+		return NewChunkWithHash(ref, data)
+	}
+
+	stored, ok := s.backend.Get(key)
+	if !ok {
+		return EmptyChunk
+	}
+	data, err := s.decodeChunkData(stored)
+	d.Chk.NoError(err)
+	return NewChunkWithHash(ref, data)
+}
+
+func (s *kvStore) Has(ref hash.Hash) bool {
+	d.Chk.True(s.backend != nil, "Cannot use store after Close().")
+	key := s.toChunkKey(ref)
+
+	s.pendingMu.Lock()
+	_, isPending := s.pending[string(key)]
+	s.pendingMu.Unlock()
+	if isPending {
+		return true
+	}
+
+	return s.backend.Has(key)
+}
+
+func (s *kvStore) Put(c Chunk) {
+	d.Chk.True(s.backend != nil, "Cannot use store after Close().")
+	err := s.backend.Put(s.toChunkKey(c.Hash()), s.encodeChunkData(c.Data()))
+	d.Chk.NoError(err)
+}
+
+// PutMany queues chunks to be durably written by the next Commit (including
+// the one UpdateRoot issues), rather than writing them immediately. This is
+// what lets a caller's "flush the working set, then advance the root" be a
+// single atomic transaction instead of a put-then-CAS race: if the root CAS
+// loses, the chunks it was flushing haven't been written as some dangling,
+// unreferenced-by-any-root garbage either -- they're just retried with the
+// next Commit attempt.
+func (s *kvStore) PutMany(chunks []Chunk) (e BackpressureError) {
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pending = map[string]Op{}
+	}
+	for _, c := range chunks {
+		key := s.toChunkKey(c.Hash())
+		s.pending[string(key)] = Op{Key: key, Value: s.encodeChunkData(c.Data())}
+	}
+	s.pendingMu.Unlock()
+	return
+}
+
+func (s *kvStore) Close() error {
+	// Flush whatever PutMany queued but no Commit ever picked up. It can no
+	// longer land atomically with a root swap, but writing it plainly beats
+	// silently discarding chunks a caller believed PutMany had accepted.
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.pendingMu.Unlock()
+	if len(pending) > 0 {
+		kvs := make([]KV, 0, len(pending))
+		for _, op := range pending {
+			kvs = append(kvs, op)
+		}
+		d.Chk.NoError(s.backend.PutBatch(kvs))
+	}
+
+	if s.closeBackingStore {
+		s.backend.Close()
+	}
+	s.backend = nil
+	return nil
+}
+
+func (s *kvStore) toChunkKey(r hash.Hash) []byte {
+	digest := r.DigestSlice()
+	out := make([]byte, len(s.chunkPrefix), len(s.chunkPrefix)+len(digest))
+	copy(out, s.chunkPrefix)
+	return append(out, digest...)
+}
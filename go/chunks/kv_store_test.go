@@ -0,0 +1,122 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/attic-labs/noms/go/hash"
+)
+
+// TestCommitKeepsPendingVisibleDuringCAS guards against the read-your-writes
+// gap fixed by the chunk0-2 review follow-up: a chunk PutMany has accepted
+// must stay visible to Get/Has for as long as the Commit flushing it is in
+// flight, not just until the CompareAndSwap is issued.
+func TestCommitKeepsPendingVisibleDuringCAS(t *testing.T) {
+	backend := newFakeBackend()
+	s := newKVStore(backend, []byte("ns/"), true)
+
+	c := NewChunk([]byte("hello"))
+	if bp := s.PutMany([]Chunk{c}); bp != nil {
+		t.Fatalf("PutMany: %v", bp)
+	}
+
+	inCAS := make(chan struct{})
+	release := make(chan struct{})
+	backend.casHook = func() {
+		close(inCAS)
+		<-release
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ok, err := s.Commit(nil, hash.Hash{}, hash.Hash{1})
+		if !ok || err != nil {
+			t.Errorf("Commit: ok=%v err=%v", ok, err)
+		}
+	}()
+
+	<-inCAS
+	if !s.Has(c.Hash()) {
+		t.Error("Has returned false for a chunk mid-Commit; pending was cleared too early")
+	}
+	if got := s.Get(c.Hash()); got.IsEmpty() {
+		t.Error("Get returned EmptyChunk for a chunk mid-Commit; pending was cleared too early")
+	}
+	close(release)
+	<-done
+
+	if !s.Has(c.Hash()) {
+		t.Error("Has returned false for a chunk after a successful Commit")
+	}
+}
+
+// TestCommitRestoresPendingOnFailedCAS checks that a PutMany-sourced chunk
+// survives a Commit whose CompareAndSwap loses the race, so a caller that
+// retries doesn't lose writes PutMany already accepted.
+func TestCommitRestoresPendingOnFailedCAS(t *testing.T) {
+	backend := newFakeBackend()
+	s := newKVStore(backend, []byte("ns/"), true)
+
+	c := NewChunk([]byte("world"))
+	if bp := s.PutMany([]Chunk{c}); bp != nil {
+		t.Fatalf("PutMany: %v", bp)
+	}
+
+	// expectedRoot doesn't match the store's actual (zero) root, so the CAS
+	// is expected to lose.
+	ok, err := s.Commit(nil, hash.Hash{1}, hash.Hash{2})
+	if ok || err != nil {
+		t.Fatalf("Commit: expected a lost CAS, got ok=%v err=%v", ok, err)
+	}
+
+	if !s.Has(c.Hash()) {
+		t.Error("chunk PutMany accepted was lost after a failed Commit")
+	}
+}
+
+// TestCommitConcurrentPutManyDuringCAS makes sure a PutMany racing a
+// Commit's CompareAndSwap doesn't have its chunk discarded: the Commit must
+// only clear the pending entries it actually read into its own snapshot.
+func TestCommitConcurrentPutManyDuringCAS(t *testing.T) {
+	backend := newFakeBackend()
+	s := newKVStore(backend, []byte("ns/"), true)
+
+	first := NewChunk([]byte("first"))
+	second := NewChunk([]byte("second"))
+	if bp := s.PutMany([]Chunk{first}); bp != nil {
+		t.Fatalf("PutMany: %v", bp)
+	}
+
+	inCAS := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	backend.casHook = func() {
+		once.Do(func() { close(inCAS) })
+		<-release
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ok, err := s.Commit(nil, hash.Hash{}, hash.Hash{1})
+		if !ok || err != nil {
+			t.Errorf("Commit: ok=%v err=%v", ok, err)
+		}
+	}()
+
+	<-inCAS
+	if bp := s.PutMany([]Chunk{second}); bp != nil {
+		t.Fatalf("PutMany: %v", bp)
+	}
+	close(release)
+	<-done
+
+	if !s.Has(second.Hash()) {
+		t.Error("a chunk PutMany accepted while a Commit's CAS was in flight was lost")
+	}
+}
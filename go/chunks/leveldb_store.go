@@ -8,20 +8,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"sync"
 
 	"github.com/attic-labs/noms/go/d"
-	"github.com/attic-labs/noms/go/hash"
-	"github.com/golang/snappy"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
-)
-
-const (
-	rootKeyConst     = "/root"
-	chunkPrefixConst = "/chunk/"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type LevelDBStoreFlags struct {
@@ -43,95 +36,60 @@ func RegisterLevelDBFlags() {
 }
 
 func NewLevelDBStoreUseFlags(dir, ns string) *LevelDBStore {
-	return newLevelDBStore(newBackingStore(dir, ldbFlags.maxFileHandles, ldbFlags.dumpStats), []byte(ns), true)
+	return newLevelDBStore(newLevelDBBackend(dir, ldbFlags.maxFileHandles, ldbFlags.dumpStats), []byte(ns), true)
 }
 
 func NewLevelDBStore(dir, ns string, maxFileHandles int, dumpStats bool) *LevelDBStore {
-	return newLevelDBStore(newBackingStore(dir, maxFileHandles, dumpStats), []byte(ns), true)
+	return newLevelDBStore(newLevelDBBackend(dir, maxFileHandles, dumpStats), []byte(ns), true)
 }
 
-func newLevelDBStore(store *internalLevelDBStore, ns []byte, closeBackingStore bool) *LevelDBStore {
-	copyNsAndAppend := func(suffix string) (out []byte) {
-		out = make([]byte, len(ns)+len(suffix))
-		copy(out[copy(out, ns):], []byte(suffix))
-		return
-	}
-	return &LevelDBStore{
-		internalLevelDBStore: store,
-		rootKey:              copyNsAndAppend(rootKeyConst),
-		chunkPrefix:          copyNsAndAppend(chunkPrefixConst),
-		closeBackingStore:    closeBackingStore,
-	}
+func newLevelDBStore(backend *leveldbBackend, ns []byte, closeBackingStore bool) *LevelDBStore {
+	return &LevelDBStore{newKVStore(backend, ns, closeBackingStore)}
 }
 
+// LevelDBStore is a ChunkStore backed by goleveldb. It no longer owns any
+// leveldb-specific logic beyond constructing a leveldbBackend; the
+// namespacing, chunk encoding, and root CAS semantics all live in the
+// backend-agnostic kvStore, which BadgerStore shares.
 type LevelDBStore struct {
-	*internalLevelDBStore
-	rootKey           []byte
-	chunkPrefix       []byte
-	closeBackingStore bool
-}
-
-func (l *LevelDBStore) Root() hash.Hash {
-	d.Chk.True(l.internalLevelDBStore != nil, "Cannot use LevelDBStore after Close().")
-	return l.rootByKey(l.rootKey)
-}
-
-func (l *LevelDBStore) UpdateRoot(current, last hash.Hash) bool {
-	d.Chk.True(l.internalLevelDBStore != nil, "Cannot use LevelDBStore after Close().")
-	return l.updateRootByKey(l.rootKey, current, last)
-}
-
-func (l *LevelDBStore) Get(ref hash.Hash) Chunk {
-	d.Chk.True(l.internalLevelDBStore != nil, "Cannot use LevelDBStore after Close().")
-	return l.getByKey(l.toChunkKey(ref), ref)
+	kvStore
 }
 
-func (l *LevelDBStore) Has(ref hash.Hash) bool {
-	d.Chk.True(l.internalLevelDBStore != nil, "Cannot use LevelDBStore after Close().")
-	return l.hasByKey(l.toChunkKey(ref))
+func NewLevelDBStoreFactory(dir string, maxHandles int, dumpStats bool) Factory {
+	return &LevelDBStoreFactory{dir, maxHandles, dumpStats, newLevelDBBackend(dir, maxHandles, dumpStats)}
 }
 
-func (l *LevelDBStore) Put(c Chunk) {
-	d.Chk.True(l.internalLevelDBStore != nil, "Cannot use LevelDBStore after Close().")
-	l.putByKey(l.toChunkKey(c.Hash()), c)
+func NewLevelDBStoreFactoryUseFlags(dir string) Factory {
+	return NewLevelDBStoreFactory(dir, ldbFlags.maxFileHandles, ldbFlags.dumpStats)
 }
 
-func (l *LevelDBStore) PutMany(chunks []Chunk) (e BackpressureError) {
-	numBytes := 0
-	b := new(leveldb.Batch)
-	for _, c := range chunks {
-		data := snappy.Encode(nil, c.Data())
-		numBytes += len(data)
-		b.Put(l.toChunkKey(c.Hash()), data)
-	}
-	l.putBatch(b, numBytes)
-	return
+type LevelDBStoreFactory struct {
+	dir            string
+	maxFileHandles int
+	dumpStats      bool
+	backend        *leveldbBackend
 }
 
-func (l *LevelDBStore) Close() error {
-	if l.closeBackingStore {
-		l.internalLevelDBStore.Close()
-	}
-	l.internalLevelDBStore = nil
-	return nil
+func (f *LevelDBStoreFactory) CreateStore(ns string) ChunkStore {
+	d.Chk.True(f.backend != nil, "Cannot use LevelDBStoreFactory after Shutter().")
+	return newLevelDBStore(f.backend, []byte(ns), false)
 }
 
-func (l *LevelDBStore) toChunkKey(r hash.Hash) []byte {
-	digest := r.DigestSlice()
-	out := make([]byte, len(l.chunkPrefix), len(l.chunkPrefix)+len(digest))
-	copy(out, l.chunkPrefix)
-	return append(out, digest...)
+func (f *LevelDBStoreFactory) Shutter() {
+	f.backend.Close()
+	f.backend = nil
 }
 
-type internalLevelDBStore struct {
+// leveldbBackend is a KVBackend backed by a single goleveldb database
+// handle, shared across every namespaced LevelDBStore opened on top of it.
+type leveldbBackend struct {
 	db                                     *leveldb.DB
-	mu                                     *sync.Mutex
 	concurrentWriteLimit                   chan struct{}
 	getCount, hasCount, putCount, putBytes int64
 	dumpStats                              bool
 }
 
-func newBackingStore(dir string, maxFileHandles int, dumpStats bool) *internalLevelDBStore {
+func newLevelDBBackend(dir string, maxFileHandles int, dumpStats bool) *leveldbBackend {
 	d.Exp.NotEmpty(dir)
 	d.Exp.NoError(os.MkdirAll(dir, 0700))
 	db, err := leveldb.OpenFile(dir, &opt.Options{
@@ -140,77 +98,117 @@ func newBackingStore(dir string, maxFileHandles int, dumpStats bool) *internalLe
 		OpenFilesCacheCapacity: maxFileHandles,
 		WriteBuffer:            1 << 24, // 16MiB,
 	})
-	d.Chk.NoError(err, "opening internalLevelDBStore in %s", dir)
-	return &internalLevelDBStore{
+	d.Chk.NoError(err, "opening leveldbBackend in %s", dir)
+	return &leveldbBackend{
 		db:                   db,
-		mu:                   &sync.Mutex{},
 		concurrentWriteLimit: make(chan struct{}, maxFileHandles),
 		dumpStats:            dumpStats,
 	}
 }
 
-func (l *internalLevelDBStore) rootByKey(key []byte) hash.Hash {
+func (l *leveldbBackend) Get(key []byte) ([]byte, bool) {
 	val, err := l.db.Get(key, nil)
-	if err == errors.ErrNotFound {
-		return hash.Hash{}
-	}
-	d.Chk.NoError(err)
-
-	return hash.Parse(string(val))
-}
-
-func (l *internalLevelDBStore) updateRootByKey(key []byte, current, last hash.Hash) bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	if last != l.rootByKey(key) {
-		return false
-	}
-
-	// Sync: true write option should fsync memtable data to disk
-	err := l.db.Put(key, []byte(current.String()), &opt.WriteOptions{Sync: true})
-	d.Chk.NoError(err)
-	return true
-}
-
-func (l *internalLevelDBStore) getByKey(key []byte, ref hash.Hash) Chunk {
-	compressed, err := l.db.Get(key, nil)
 	l.getCount++
 	if err == errors.ErrNotFound {
-		return EmptyChunk
+		return nil, false
 	}
 	d.Chk.NoError(err)
-	data, err := snappy.Decode(nil, compressed)
-	d.Chk.NoError(err)
-	return NewChunkWithHash(ref, data)
+	return val, true
 }
 
-func (l *internalLevelDBStore) hasByKey(key []byte) bool {
+func (l *leveldbBackend) Has(key []byte) bool {
 	exists, err := l.db.Has(key, &opt.ReadOptions{DontFillCache: true}) // This isn't really a "read", so don't signal the cache to treat it as one.
 	d.Chk.NoError(err)
 	l.hasCount++
 	return exists
 }
 
-func (l *internalLevelDBStore) putByKey(key []byte, c Chunk) {
+func (l *leveldbBackend) Put(key, val []byte) error {
 	l.concurrentWriteLimit <- struct{}{}
-	data := snappy.Encode(nil, c.Data())
-	err := l.db.Put(key, data, nil)
-	d.Chk.NoError(err)
+	err := l.db.Put(key, val, nil)
 	l.putCount++
-	l.putBytes += int64(len(data))
+	l.putBytes += int64(len(val))
 	<-l.concurrentWriteLimit
+	return err
 }
 
-func (l *internalLevelDBStore) putBatch(b *leveldb.Batch, numBytes int) {
+func (l *leveldbBackend) PutBatch(kvs []KV) error {
+	numBytes := 0
+	b := new(leveldb.Batch)
+	for _, kv := range kvs {
+		numBytes += len(kv.Value)
+		b.Put(kv.Key, kv.Value)
+	}
 	l.concurrentWriteLimit <- struct{}{}
 	err := l.db.Write(b, nil)
-	d.Chk.NoError(err)
 	l.putCount += int64(b.Len())
 	l.putBytes += int64(numBytes)
 	<-l.concurrentWriteLimit
+	return err
+}
+
+// CompareAndSwap uses goleveldb's DB.OpenTransaction rather than a
+// process-local mutex, so the compare-and-set is atomic against any other
+// writer on this DB handle -- in-process or, via the transaction's own file
+// lock, a concurrent goleveldb.OpenFile on the same directory -- not just
+// against goroutines that happen to take the same *sync.Mutex. Bundling
+// extra into the same transaction lets a caller publish a new root plus its
+// dependent ref-log/index writes as one durable unit.
+func (l *leveldbBackend) CompareAndSwap(key, expected, newVal []byte, extra []KV) (bool, error) {
+	tx, err := l.db.OpenTransaction()
+	if err != nil {
+		return false, err
+	}
+
+	cur, txErr := tx.Get(key, nil)
+	found := txErr == nil
+	if txErr != nil && txErr != errors.ErrNotFound {
+		tx.Discard()
+		return false, txErr
+	}
+	if found != (len(expected) > 0) || (found && string(cur) != string(expected)) {
+		tx.Discard()
+		return false, nil
+	}
+
+	numBytes := len(newVal)
+	// Sync: true write option should fsync the commit record to disk
+	if err := tx.Put(key, newVal, &opt.WriteOptions{Sync: true}); err != nil {
+		tx.Discard()
+		return false, err
+	}
+	for _, kv := range extra {
+		numBytes += len(kv.Value)
+		if err := tx.Put(kv.Key, kv.Value, nil); err != nil {
+			tx.Discard()
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	l.putCount += int64(1 + len(extra))
+	l.putBytes += int64(numBytes)
+	return true, nil
+}
+
+func (l *leveldbBackend) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *leveldbBackend) Iterate(prefix []byte, fn func(key, val []byte) bool) error {
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
 }
 
-func (l *internalLevelDBStore) Close() error {
+func (l *leveldbBackend) Close() error {
 	l.db.Close()
 	if l.dumpStats {
 		fmt.Println("--LevelDB Stats--")
@@ -218,31 +216,16 @@ func (l *internalLevelDBStore) Close() error {
 		fmt.Println("HasCount: ", l.hasCount)
 		fmt.Println("PutCount: ", l.putCount)
 		fmt.Println("Average PutSize: ", l.putBytes/l.putCount)
+		fmt.Print(dumpCodecStats())
 	}
 	return nil
 }
 
-func NewLevelDBStoreFactory(dir string, maxHandles int, dumpStats bool) Factory {
-	return &LevelDBStoreFactory{dir, maxHandles, dumpStats, newBackingStore(dir, maxHandles, dumpStats)}
-}
-
-func NewLevelDBStoreFactoryUseFlags(dir string) Factory {
-	return NewLevelDBStoreFactory(dir, ldbFlags.maxFileHandles, ldbFlags.dumpStats)
-}
-
-type LevelDBStoreFactory struct {
-	dir            string
-	maxFileHandles int
-	dumpStats      bool
-	store          *internalLevelDBStore
-}
-
-func (f *LevelDBStoreFactory) CreateStore(ns string) ChunkStore {
-	d.Chk.True(f.store != nil, "Cannot use LevelDBStoreFactory after Shutter().")
-	return newLevelDBStore(f.store, []byte(ns), false)
-}
-
-func (f *LevelDBStoreFactory) Shutter() {
-	f.store.Close()
-	f.store = nil
+func (l *leveldbBackend) Stats() BackendStats {
+	return BackendStats{
+		GetCount: l.getCount,
+		HasCount: l.hasCount,
+		PutCount: l.putCount,
+		PutBytes: l.putBytes,
+	}
 }
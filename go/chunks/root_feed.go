@@ -0,0 +1,281 @@
+// Copyright 2016 The Noms Authors. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package chunks
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+)
+
+var rootFeedRetention = uint64(defaultFeedRetention)
+
+// RegisterRootFeedFlags registers --root-feed-retention. It's independent
+// of RegisterChunkBackendFlags because enabling a RootFeed at all is a
+// per-store opt-in (see kvStore.EnableRootFeed), not a global setting.
+func RegisterRootFeedFlags() {
+	flag.Uint64Var(&rootFeedRetention, "root-feed-retention", defaultFeedRetention, "number of RootFeed events to retain behind the slowest subscriber's watermark")
+}
+
+// RootEvent records a single successful root transition: a ChunkStore's
+// root moved from OldRoot to NewRoot at TimestampNs, and this was the
+// SeqNo'th transition the feed has ever published.
+type RootEvent struct {
+	OldRoot     hash.Hash
+	NewRoot     hash.Hash
+	TimestampNs int64
+	SeqNo       uint64
+}
+
+// CancelFunc unsubscribes a Subscribe call: live delivery stops, and an
+// in-flight replay (see RootFeed.replay) still blocked trying to hand off
+// history is released rather than left blocked forever. It does not close
+// the returned channel; the caller should simply stop reading from it.
+type CancelFunc func()
+
+const feedPrefixConst = "/feed/"
+
+// defaultFeedRetention is how many published events RootFeed keeps in its
+// on-disk log behind the slowest subscriber's watermark, so a subscriber
+// that falls a little behind (rather than disappearing) can still resume
+// without missing anything. Overridden by --root-feed-retention.
+const defaultFeedRetention = 10000
+
+// RootFeed is a tap/upr-style "stream every durably-applied mutation" feed
+// of a ChunkStore's root transitions. It's opt-in: a kvStore only publishes
+// to one once EnableRootFeed has been called on it, so stores that don't
+// need it pay nothing. Published events go to a bounded in-memory ring
+// buffer holding the latest ringCap events, straight to each live
+// subscriber's buffered channel, and to an append-only on-disk log keyed
+// "/feed/<seq>" through the same KVBackend the store itself uses (for
+// subscribers that need to replay history, including across a process
+// restart). Subscribe replays from the on-disk log only; it does not read
+// the ring.
+type RootFeed struct {
+	backend   KVBackend
+	prefix    []byte
+	retention uint64
+
+	mu           sync.Mutex
+	ring         []RootEvent
+	ringCap      int
+	nextSeq      uint64
+	subs         map[uint64]*feedSub
+	nextSub      uint64
+	sincePublish uint64
+}
+
+// compactInterval is how many publishes pass between compact passes. compact
+// is cheap to skip and expensive to run (a full scan of the on-disk log), so
+// it isn't worth re-checking on every single commit to a store with the feed
+// enabled -- the log only grows by compactInterval entries in the meantime,
+// nowhere near enough to matter against a retention window in the
+// thousands.
+const compactInterval = 128
+
+type feedSub struct {
+	ch     chan RootEvent
+	minSeq uint64
+	// done is closed by CancelFunc, unblocking this sub's in-flight replay
+	// goroutine (see RootFeed.replay) if it's still sending.
+	done chan struct{}
+}
+
+func newRootFeed(backend KVBackend, ns []byte, retention uint64) *RootFeed {
+	prefix := make([]byte, len(ns)+len(feedPrefixConst))
+	copy(prefix[copy(prefix, ns):], []byte(feedPrefixConst))
+
+	f := &RootFeed{
+		backend:   backend,
+		prefix:    prefix,
+		retention: retention,
+		ringCap:   256,
+		subs:      map[uint64]*feedSub{},
+	}
+
+	// Recover nextSeq across a restart by scanning the persisted log for the
+	// highest seq already written; entries older than the retention window
+	// may already be gone, but seq numbers must stay monotonic regardless.
+	_ = backend.Iterate(prefix, func(key, val []byte) bool {
+		if ev, err := decodeRootEvent(val); err == nil && ev.SeqNo >= f.nextSeq {
+			f.nextSeq = ev.SeqNo + 1
+		}
+		return true
+	})
+
+	return f
+}
+
+func (f *RootFeed) seqKey(seq uint64) []byte {
+	return append(append([]byte{}, f.prefix...), []byte(fmt.Sprintf("%020d", seq))...)
+}
+
+// rootEventWire is RootEvent's on-disk encoding. hash.Hash has no exported
+// fields for encoding/json to see, so events are marshaled through their
+// string form, the same way kvStore itself stores a root.
+type rootEventWire struct {
+	OldRoot     string `json:"old_root"`
+	NewRoot     string `json:"new_root"`
+	TimestampNs int64  `json:"timestamp_ns"`
+	SeqNo       uint64 `json:"seq_no"`
+}
+
+func encodeRootEvent(ev RootEvent) []byte {
+	data, _ := json.Marshal(rootEventWire{
+		OldRoot:     ev.OldRoot.String(),
+		NewRoot:     ev.NewRoot.String(),
+		TimestampNs: ev.TimestampNs,
+		SeqNo:       ev.SeqNo,
+	})
+	return data
+}
+
+func decodeRootEvent(data []byte) (RootEvent, error) {
+	var w rootEventWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return RootEvent{}, err
+	}
+	return RootEvent{
+		OldRoot:     hash.Parse(w.OldRoot),
+		NewRoot:     hash.Parse(w.NewRoot),
+		TimestampNs: w.TimestampNs,
+		SeqNo:       w.SeqNo,
+	}, nil
+}
+
+// publish appends a RootEvent for the old->new root transition to the
+// on-disk log (best-effort, see below) and delivers it to every live
+// subscriber's buffer. Every compactInterval'th
+// publish also triggers a compaction pass keyed off the slowest subscriber's
+// watermark; compact is a full scan of the on-disk log, so running it on
+// every single commit to a feed-enabled store would be a real cost on the
+// commit path for a log that's only grown by one entry since last time.
+func (f *RootFeed) publish(old, new hash.Hash) {
+	f.mu.Lock()
+	seq := f.nextSeq
+	f.nextSeq++
+	ev := RootEvent{OldRoot: old, NewRoot: new, TimestampNs: time.Now().UnixNano(), SeqNo: seq}
+	f.mu.Unlock()
+
+	// Best-effort: a failed log write shouldn't fail the root update it's
+	// reporting on, since the update has already committed by the time
+	// publish is called.
+	_ = f.backend.Put(f.seqKey(seq), encodeRootEvent(ev))
+
+	f.mu.Lock()
+	f.ring = append(f.ring, ev)
+	if len(f.ring) > f.ringCap {
+		f.ring = f.ring[len(f.ring)-f.ringCap:]
+	}
+	for _, sub := range f.subs {
+		select {
+		case sub.ch <- ev:
+			sub.minSeq = seq
+		default:
+			// A slow subscriber doesn't block publish; it just has a gap to
+			// discover and fill in by resuming Subscribe from its last seen
+			// seq (as long as that seq is still within the retention window).
+		}
+	}
+	f.sincePublish++
+	runCompact := f.sincePublish >= compactInterval
+	if runCompact {
+		f.sincePublish = 0
+	}
+	f.mu.Unlock()
+
+	if runCompact {
+		f.compact()
+	}
+}
+
+// Subscribe returns a channel that first replays every retained event with
+// SeqNo >= fromSeq, then tails new events as they're published, plus a
+// CancelFunc to unsubscribe. Replay runs concurrently with live delivery, so
+// an event published right at the history/live boundary may be delivered
+// twice; RootEvent.SeqNo lets a consumer dedupe if that matters to it.
+func (f *RootFeed) Subscribe(fromSeq uint64) (<-chan RootEvent, CancelFunc) {
+	ch := make(chan RootEvent, f.ringCap)
+	done := make(chan struct{})
+
+	f.mu.Lock()
+	subID := f.nextSub
+	f.nextSub++
+	sub := &feedSub{ch: ch, minSeq: fromSeq, done: done}
+	f.subs[subID] = sub
+	f.mu.Unlock()
+
+	go f.replay(fromSeq, ch, done)
+
+	var cancelOnce sync.Once
+	cancel := func() {
+		cancelOnce.Do(func() {
+			f.mu.Lock()
+			delete(f.subs, subID)
+			f.mu.Unlock()
+			close(done)
+		})
+	}
+	return ch, cancel
+}
+
+// replay delivers every retained event with SeqNo >= fromSeq, blocking on
+// send rather than dropping on a full buffer: unlike live publish, a
+// replaying subscriber hasn't started consuming yet, so a full channel just
+// means it's slow to start, not that it should lose history the "first
+// replays every retained event" contract promises it. It stops early,
+// without error, once done is closed -- by CancelFunc, or implicitly once
+// this sub is dropped from f.subs -- so a cancelled-but-unfinished replay
+// doesn't block on a send nobody will ever read.
+func (f *RootFeed) replay(fromSeq uint64, ch chan<- RootEvent, done <-chan struct{}) {
+	_ = f.backend.Iterate(f.prefix, func(key, val []byte) bool {
+		ev, err := decodeRootEvent(val)
+		if err != nil || ev.SeqNo < fromSeq {
+			return true
+		}
+		select {
+		case ch <- ev:
+			return true
+		case <-done:
+			return false
+		}
+	})
+}
+
+// compact deletes persisted log entries older than retention events behind
+// the slowest active subscriber's watermark. With no subscribers, the
+// watermark is the feed's own tip, so the whole log ages out down to
+// retention entries; a brand-new subscriber only misses history it
+// couldn't have asked for anyway.
+func (f *RootFeed) compact() {
+	f.mu.Lock()
+	watermark := f.nextSeq
+	for _, sub := range f.subs {
+		if sub.minSeq < watermark {
+			watermark = sub.minSeq
+		}
+	}
+	f.mu.Unlock()
+
+	if watermark < f.retention {
+		return
+	}
+	cutoff := watermark - f.retention
+
+	var toDelete [][]byte
+	_ = f.backend.Iterate(f.prefix, func(key, val []byte) bool {
+		if ev, err := decodeRootEvent(val); err == nil && ev.SeqNo < cutoff {
+			toDelete = append(toDelete, append([]byte{}, key...))
+		}
+		return true
+	})
+	for _, key := range toDelete {
+		_ = f.backend.Delete(key)
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mvdata
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/attic-labs/noms/go/chunks"
+
+	"github.com/dolthub/dolt/go/libraries/doltcore/doltdb"
+	"github.com/dolthub/dolt/go/libraries/doltcore/env"
+	"github.com/dolthub/dolt/go/libraries/doltcore/row"
+	"github.com/dolthub/dolt/go/libraries/doltcore/schema"
+	"github.com/dolthub/dolt/go/libraries/doltcore/schema/encoding"
+	"github.com/dolthub/dolt/go/libraries/doltcore/table"
+	"github.com/dolthub/dolt/go/libraries/doltcore/table/typed/noms"
+	"github.com/dolthub/dolt/go/store/types"
+)
+
+// bulkLoadCheckpointRate is both how many rows a bulkLoadingWriteCloser
+// buffers in memory before sorting and spilling them as one run (see
+// spillRun), and how many rows pass between manifest checkpoints. The two
+// are tied together deliberately: a checkpoint is only durable once the
+// rows behind it have actually been spilled, so every checkpoint write is
+// preceded by a spill. This mirrors the cadence of tableWriterStatUpdateRate.
+const bulkLoadCheckpointRate = 2 << 15
+
+// bulkImportManifest is the on-disk checkpoint record for a
+// bulkLoadingWriteCloser. An interrupted `dolt table import` can read it
+// back and skip re-feeding rows up through LastCommittedPK, rather than
+// starting the external sort over from the beginning of the source.
+type bulkImportManifest struct {
+	// LastCommittedPK is the noms-encoded primary key Tuple of the last row
+	// durably spilled to the scratch store.
+	LastCommittedPK []byte `json:"last_committed_pk"`
+	// RowCount is the number of rows spilled as of LastCommittedPK.
+	RowCount int64 `json:"row_count"`
+}
+
+func bulkLoadManifestPath(dEnv *env.DoltEnv, tableName string) string {
+	return filepath.Join(dEnv.GetDoltDir(), "import", tableName+".checkpoint")
+}
+
+func bulkLoadScratchDir(dEnv *env.DoltEnv, tableName string) string {
+	return filepath.Join(dEnv.GetDoltDir(), "import", tableName+".scratch")
+}
+
+// NewBulkLoadingWriter returns a TableWriteCloser tuned for loading a large,
+// previously-empty table: rows are buffered in memory up to
+// bulkLoadCheckpointRate at a time, sorted into logical primary-key order,
+// and spilled as one "run" to a scratch chunks.KVBackend (chunks.
+// NewLevelDBBackend), rather than threaded one at a time through a
+// SessionedTableEditor or held in memory for the whole import. Flush reads
+// every run back in parallel and k-way merges them -- each run is already
+// sorted, so the merge only ever needs one buffered row per run in memory
+// at a time -- and streams the merged, fully-sorted (pk, value) sequence
+// straight into types.NewStreamingMap, which builds the table's new prolly
+// tree bottom-up as the stream arrives instead of the per-row editor's
+// repeated re-walk-and-re-encode, or a sort that holds the whole import's
+// rows in RAM at once.
+//
+// Progress is checkpointed to a manifest file every bulkLoadCheckpointRate
+// rows, so a caller driving an interrupted import can read the manifest
+// back via ResumePK and skip re-submitting rows it already spilled; the
+// scratch store itself survives between runs, so a run that was fully
+// spilled before a crash is read back by Flush exactly as before.
+//
+// If the target table already exists and is non-empty, this degrades to
+// NewUpdatingWriter: merging newly-imported rows against existing ones is
+// exactly what the per-row editor already does, and a from-scratch bulk
+// rebuild has no cheap way to detect which incoming keys collide with rows
+// it didn't itself just write.
+func (dl TableDataLocation) NewBulkLoadingWriter(ctx context.Context, dEnv *env.DoltEnv, root *doltdb.RootValue, outSch schema.Schema, statsCB noms.StatsCB) (table.TableWriteCloser, error) {
+	exists, err := dl.Exists(ctx, root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		tbl, _, err := root.GetTable(ctx, dl.Name)
+		if err != nil {
+			return nil, err
+		}
+		rowData, err := tbl.GetRowData(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if rowData.Len() > 0 {
+			return dl.NewUpdatingWriter(ctx, DataMoverOptions{}, dEnv, root, false, outSch, statsCB)
+		}
+	}
+
+	if outSch.GetPKCols().Size() == 0 {
+		return nil, ErrNoPK
+	}
+
+	scratchDir := bulkLoadScratchDir(dEnv, dl.Name)
+	manifestPath := bulkLoadManifestPath(dEnv, dl.Name)
+
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return nil, err
+	}
+
+	resumePK, resumeCount := readBulkImportManifest(manifestPath)
+
+	// Every checkpoint follows a spill of exactly bulkLoadCheckpointRate rows,
+	// so the runs already in the scratch store are numbered
+	// 0..resumeCount/bulkLoadCheckpointRate-1; new runs go after them.
+	return &bulkLoadingWriteCloser{
+		dl:           dl,
+		root:         root,
+		tableSch:     outSch,
+		statsCB:      statsCB,
+		scratch:      chunks.NewLevelDBBackend(scratchDir, 24, false),
+		scratchDir:   scratchDir,
+		manifestPath: manifestPath,
+		runCount:     int(resumeCount / bulkLoadCheckpointRate),
+		rowCount:     resumeCount,
+		resumePK:     resumePK,
+	}, nil
+}
+
+// ResumePK returns the primary key Tuple (noms-encoded) of the last row a
+// previous, interrupted run of this import already spilled to the scratch
+// store, and whether a checkpoint was found at all. A caller should skip
+// feeding WriteRow any source row at or before this key.
+func ResumePK(w table.TableWriteCloser) (pk []byte, ok bool) {
+	if b, isBulk := w.(*bulkLoadingWriteCloser); isBulk && len(b.resumePK) > 0 {
+		return b.resumePK, true
+	}
+	return nil, false
+}
+
+func readBulkImportManifest(path string) (pk []byte, rowCount int64) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0
+	}
+	var m bulkImportManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, 0
+	}
+	return m.LastCommittedPK, m.RowCount
+}
+
+func writeBulkImportManifest(path string, pk []byte, rowCount int64) error {
+	data, err := json.Marshal(bulkImportManifest{LastCommittedPK: pk, RowCount: rowCount})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// pkValPair is one decoded (primary key, value) Tuple pair, either buffered
+// in memory ahead of a spill or read back out of a run during Flush's merge.
+type pkValPair struct {
+	pk, val types.Value
+}
+
+type bulkLoadingWriteCloser struct {
+	dl       TableDataLocation
+	root     *doltdb.RootValue
+	tableSch schema.Schema
+
+	statsCB noms.StatsCB
+	stats   types.AppliedEditStats
+
+	scratch      chunks.KVBackend
+	scratchDir   string
+	manifestPath string
+
+	// buf accumulates up to bulkLoadCheckpointRate rows before spillRun
+	// sorts and spills them as the next run, keeping memory use bounded to
+	// one run's worth of rows regardless of the import's total size.
+	buf      []pkValPair
+	runCount int
+
+	rowCount int64
+	lastPK   []byte
+	resumePK []byte
+}
+
+var _ DataMoverCloser = (*bulkLoadingWriteCloser)(nil)
+
+// GetSchema implements TableWriteCloser
+func (b *bulkLoadingWriteCloser) GetSchema() schema.Schema {
+	return b.tableSch
+}
+
+// WriteRow implements TableWriteCloser. It does not touch the table editor
+// at all; it just buffers the row's PK/value Tuples in memory, spilling a
+// sorted run to the scratch store every bulkLoadCheckpointRate rows (see
+// spillRun) instead of growing an in-memory buffer for the whole import.
+func (b *bulkLoadingWriteCloser) WriteRow(ctx context.Context, r row.Row) error {
+	pkTuple, err := r.NomsMapKey(b.tableSch).Value(ctx)
+	if err != nil {
+		return err
+	}
+	valTuple, err := r.NomsMapValue(b.tableSch).Value(ctx)
+	if err != nil {
+		return err
+	}
+
+	pkBytes, err := types.EncodeValue(pkTuple, nil)
+	if err != nil {
+		return err
+	}
+
+	b.buf = append(b.buf, pkValPair{pkTuple, valTuple})
+	b.lastPK = pkBytes
+	b.rowCount++
+	b.stats.Additions++
+
+	if b.rowCount%bulkLoadCheckpointRate == 0 {
+		if err := b.spillRun(ctx); err != nil {
+			return err
+		}
+		if b.statsCB != nil {
+			b.statsCB(b.stats)
+		}
+		if err := writeBulkImportManifest(b.manifestPath, b.lastPK, b.rowCount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runPrefix is the scratch-store key prefix holding the idx'th spilled run.
+// Within a run, entries are keyed by a zero-padded sequence number rather
+// than by PK bytes -- spillRun already sorted the run into logical PK
+// order before writing it, so the sequence number alone is enough to read
+// the run back in that same order (the same trick RootFeed's on-disk log
+// uses to stay ordered by sequence rather than by content).
+func runPrefix(idx int) []byte {
+	return []byte(fmt.Sprintf("/run/%08d/", idx))
+}
+
+// encodeRunEntry packs a run entry's noms-encoded PK and value into a
+// single scratch-store value, length-prefixing the PK so decodeRunEntry can
+// split them back apart.
+func encodeRunEntry(pkBytes, valBytes []byte) []byte {
+	buf := make([]byte, 4+len(pkBytes)+len(valBytes))
+	binary.BigEndian.PutUint32(buf, uint32(len(pkBytes)))
+	copy(buf[4:], pkBytes)
+	copy(buf[4+len(pkBytes):], valBytes)
+	return buf
+}
+
+func decodeRunEntry(stored []byte) (pkBytes, valBytes []byte, err error) {
+	if len(stored) < 4 {
+		return nil, nil, fmt.Errorf("decodeRunEntry: stored value too short to contain a length prefix: %d bytes", len(stored))
+	}
+	pkLen := int(binary.BigEndian.Uint32(stored))
+	if len(stored) < 4+pkLen {
+		return nil, nil, fmt.Errorf("decodeRunEntry: stored value too short for its own PK length prefix")
+	}
+	return stored[4 : 4+pkLen], stored[4+pkLen:], nil
+}
+
+// spillRun sorts the buffered rows into logical primary-key order and
+// writes them to the scratch store as the next run, then clears the buffer.
+// It's a no-op if nothing is buffered, so Flush can call it unconditionally
+// to pick up a final, partial run.
+func (b *bulkLoadingWriteCloser) spillRun(ctx context.Context) error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	nbf := b.root.VRW().Format()
+	var sortErr error
+	sort.Slice(b.buf, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		less, err := b.buf[i].pk.Less(nbf, b.buf[j].pk)
+		if err != nil {
+			sortErr = err
+			return false
+		}
+		return less
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+
+	prefix := runPrefix(b.runCount)
+	for i, pair := range b.buf {
+		pkBytes, err := types.EncodeValue(pair.pk, nil)
+		if err != nil {
+			return err
+		}
+		valBytes, err := types.EncodeValue(pair.val, nil)
+		if err != nil {
+			return err
+		}
+		key := append(append([]byte{}, prefix...), []byte(fmt.Sprintf("%020d", i))...)
+		if err := b.scratch.Put(key, encodeRunEntry(pkBytes, valBytes)); err != nil {
+			return err
+		}
+	}
+
+	b.runCount++
+	b.buf = b.buf[:0]
+	return nil
+}
+
+// runEvent is one item read back from a spilled run during Flush's merge:
+// either a decoded pair, in logical PK order within that run, or a terminal
+// decode error.
+type runEvent struct {
+	pair pkValPair
+	err  error
+}
+
+// startRunCursor reads the idx'th run back in its spilled (i.e. logical PK)
+// order, decoding each entry and delivering it on the returned channel. It
+// stops early -- closing the channel without necessarily reaching the end
+// of the run -- as soon as done is closed, so a merge that finishes or
+// aborts early doesn't leave this goroutine blocked forever on a send
+// nothing will ever read (the same leak startRunCursor's caller, the
+// mergeRuns loop, is careful to avoid for its own consumers in turn).
+func (b *bulkLoadingWriteCloser) startRunCursor(idx int, vrw types.ValueReadWriter, done <-chan struct{}) <-chan runEvent {
+	out := make(chan runEvent, 64)
+	prefix := runPrefix(idx)
+	go func() {
+		defer close(out)
+		_ = b.scratch.Iterate(prefix, func(key, val []byte) bool {
+			pkBytes, valBytes, err := decodeRunEntry(val)
+			if err == nil {
+				var pk, v types.Value
+				if pk, err = types.DecodeValue(pkBytes, vrw); err == nil {
+					v, err = types.DecodeValue(valBytes, vrw)
+					if err == nil {
+						select {
+						case out <- runEvent{pair: pkValPair{pk, v}}:
+							select {
+							case <-done:
+								return false
+							default:
+								return true
+							}
+						case <-done:
+							return false
+						}
+					}
+				}
+			}
+			select {
+			case out <- runEvent{err: err}:
+			case <-done:
+			}
+			return false
+		})
+	}()
+	return out
+}
+
+// mergeRunsHeap is a container/heap.Interface over the current head of each
+// still-open run cursor, ordered by the cursors' PK Values in logical
+// order. Less can't return the error PK.Less itself can -- heap.Interface
+// has no room for one -- so a comparison error is stashed in *err and
+// checked by the caller once heap operations are done for the round.
+type mergeRunsHeap struct {
+	cursors []*mergeCursor
+	nbf     *types.NomsBinFormat
+	err     *error
+}
+
+type mergeCursor struct {
+	ch  <-chan runEvent
+	cur pkValPair
+}
+
+func (h *mergeRunsHeap) Len() int      { return len(h.cursors) }
+func (h *mergeRunsHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *mergeRunsHeap) Less(i, j int) bool {
+	if *h.err != nil {
+		return false
+	}
+	less, err := h.cursors[i].cur.pk.Less(h.nbf, h.cursors[j].cur.pk)
+	if err != nil {
+		*h.err = err
+		return false
+	}
+	return less
+}
+func (h *mergeRunsHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*mergeCursor)) }
+func (h *mergeRunsHeap) Pop() interface{} {
+	old := h.cursors
+	n := len(old)
+	c := old[n-1]
+	h.cursors = old[:n-1]
+	return c
+}
+
+// mergeRuns k-way merges every spilled run into logical PK order and writes
+// the result, alternating PK and value, to out for types.NewStreamingMap to
+// consume -- never holding more than one buffered row per open run in
+// memory at once, regardless of how many rows the import has in total. It
+// always closes out, whether it returns an error or not.
+func (b *bulkLoadingWriteCloser) mergeRuns(ctx context.Context, vrw types.ValueReadWriter, out chan<- types.Value) error {
+	defer close(out)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	var mergeErr error
+	h := &mergeRunsHeap{nbf: vrw.Format(), err: &mergeErr}
+	for i := 0; i < b.runCount; i++ {
+		ch := b.startRunCursor(i, vrw, done)
+		ev, ok := <-ch
+		if !ok {
+			continue // an empty run
+		}
+		if ev.err != nil {
+			return ev.err
+		}
+		h.cursors = append(h.cursors, &mergeCursor{ch: ch, cur: ev.pair})
+	}
+	heap.Init(h)
+	if mergeErr != nil {
+		return mergeErr
+	}
+
+	for h.Len() > 0 {
+		c := h.cursors[0]
+
+		select {
+		case out <- c.cur.pk:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case out <- c.cur.val:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		ev, ok := <-c.ch
+		if !ok {
+			heap.Pop(h)
+			continue
+		}
+		if ev.err != nil {
+			return ev.err
+		}
+		c.cur = ev.pair
+		heap.Fix(h, 0)
+
+		if mergeErr != nil {
+			return mergeErr
+		}
+	}
+
+	return nil
+}
+
+// Flush spills any rows still buffered as a final run, then k-way merges
+// every run (see mergeRuns) straight into types.NewStreamingMap, which
+// builds the table's new prolly tree bottom-up as the merged stream arrives
+// rather than from a fully materialized, in-memory slice of it.
+func (b *bulkLoadingWriteCloser) Flush(ctx context.Context) (*doltdb.RootValue, error) {
+	if err := b.spillRun(ctx); err != nil {
+		return nil, err
+	}
+
+	vrw := b.root.VRW()
+
+	kvChan := make(chan types.Value, 128)
+	mapCh := types.NewStreamingMap(ctx, vrw, kvChan)
+
+	mergeErrCh := make(chan error, 1)
+	go func() {
+		mergeErrCh <- b.mergeRuns(ctx, vrw, kvChan)
+	}()
+
+	m := <-mapCh
+	if err := <-mergeErrCh; err != nil {
+		return nil, err
+	}
+
+	tblSchVal, err := encoding.MarshalSchemaAsNomsValue(ctx, vrw, b.tableSch)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl, err := doltdb.NewTable(ctx, vrw, tblSchVal, m, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.root.PutTable(ctx, b.dl.Name, tbl)
+}
+
+// Close implements TableWriteCloser. It flushes the final map, then removes
+// the scratch store and checkpoint manifest -- a successful Close means the
+// import doesn't need to resume from anything.
+func (b *bulkLoadingWriteCloser) Close(ctx context.Context) error {
+	updatedRoot, err := b.Flush(ctx)
+	if b.statsCB != nil {
+		b.statsCB(b.stats)
+	}
+
+	closeErr := b.scratch.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	_ = os.RemoveAll(b.scratchDir)
+	_ = os.Remove(b.manifestPath)
+
+	b.root = updatedRoot
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mvdata
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecodeRunEntryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name              string
+		pkBytes, valBytes []byte
+	}{
+		{"non-empty pk and value", []byte("pk-bytes"), []byte("val-bytes")},
+		{"empty value", []byte("pk-only"), nil},
+		{"empty pk", nil, []byte("val-only")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored := encodeRunEntry(test.pkBytes, test.valBytes)
+			pkBytes, valBytes, err := decodeRunEntry(stored)
+			if err != nil {
+				t.Fatalf("decodeRunEntry: %v", err)
+			}
+			if !bytes.Equal(pkBytes, test.pkBytes) {
+				t.Errorf("pkBytes: got %q, want %q", pkBytes, test.pkBytes)
+			}
+			if !bytes.Equal(valBytes, test.valBytes) {
+				t.Errorf("valBytes: got %q, want %q", valBytes, test.valBytes)
+			}
+		})
+	}
+}
+
+func TestDecodeRunEntryTooShort(t *testing.T) {
+	if _, _, err := decodeRunEntry([]byte{1, 2, 3}); err == nil {
+		t.Fatal("decodeRunEntry: expected an error for a value too short to hold a length prefix")
+	}
+	if _, _, err := decodeRunEntry([]byte{0, 0, 0, 5, 'a'}); err == nil {
+		t.Fatal("decodeRunEntry: expected an error when the PK length prefix exceeds the stored value")
+	}
+}
+
+// TestRunPrefixDistinctAndOrdered checks the two properties spillRun/
+// startRunCursor depend on: each run gets its own prefix, and zero-padding
+// keeps runs (and, via the same scheme used for in-run sequence keys) their
+// entries in numeric order when read back by a byte-lexical Iterate.
+func TestRunPrefixDistinctAndOrdered(t *testing.T) {
+	p0, p1, p9, p10 := runPrefix(0), runPrefix(1), runPrefix(9), runPrefix(10)
+	if bytes.Equal(p0, p1) {
+		t.Fatal("runPrefix(0) and runPrefix(1) must differ")
+	}
+	if !(string(p0) < string(p1) && string(p9) < string(p10)) {
+		t.Fatalf("runPrefix must sort in numeric order lexically: got %q, %q, %q, %q", p0, p1, p9, p10)
+	}
+}